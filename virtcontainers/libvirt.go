@@ -6,12 +6,21 @@
 package virtcontainers
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kata-containers/runtime/virtcontainers/device/config"
 	persistapi "github.com/kata-containers/runtime/virtcontainers/persist/api"
@@ -24,8 +33,18 @@ import (
 )
 
 const (
-	libvirtDefaultURI    = "qemu:///system"
-	libvirtConsoleSocket = "console.sock"
+	libvirtDefaultURI     = "qemu:///system"
+	libvirtConsoleSocket  = "console.sock"
+	libvirtStateImageFile = "state.img"
+
+	// stopSandboxTimeout bounds how long stopSandbox waits for the
+	// STOPPED lifecycle event before giving up on it and undefining
+	// the domain anyway.
+	stopSandboxTimeout = 5 * time.Second
+
+	// consoleRingBufferSize caps how much guest console output
+	// getSandboxConsoleOutput keeps around, in bytes (64 KiB).
+	consoleRingBufferSize = 64 * 1024
 )
 
 var libvirtDefaultKernelParams = []Param{
@@ -58,6 +77,27 @@ type libvirt struct {
 	libvirtConfig  *virtxml.Domain
 	libvirtConnect *virt.Connect
 	libvirtDomain  *virt.Domain
+
+	libvirtLifecycleCallbackID int
+	libvirtRebootCallbackID    int
+	libvirtAgentCallbackID     int
+	stopCh                     chan error
+
+	// consoleStopCh is closed by stopSandbox/disconnect to tell a
+	// running consoleProxy goroutine to give up dialing and exit,
+	// instead of retrying forever.
+	consoleStopCh chan struct{}
+
+	consoleMu  sync.Mutex
+	consoleBuf []byte
+
+	qemuPid int
+
+	// libvirtMemHotplugMB tracks how much memory has already been
+	// added on top of boot memory via virtio-mem, so a later
+	// resizeMemory call grows by the remaining delta instead of
+	// attaching a redundant device for the full amount again.
+	libvirtMemHotplugMB uint32
 }
 
 func (v *libvirt) logger() *logrus.Entry {
@@ -83,6 +123,28 @@ func (v *libvirt) hypervisorConfig() HypervisorConfig {
 	return *v.config
 }
 
+// validateFirmwareConfig checks that the firmware-related parts of a
+// HypervisorConfig are internally consistent, rejecting combinations
+// libvirt has no sane way to honour.
+//
+// This belongs alongside HypervisorConfig's own valid() method in
+// hypervisor.go, but that method isn't part of this package's
+// libvirt-specific source, so it's called explicitly from createSandbox
+// instead of being folded into valid() directly.
+func validateFirmwareConfig(conf *HypervisorConfig) error {
+	if conf.FirmwarePath != "" {
+		if conf.KernelPath != "" {
+			return errors.New("firmware and direct kernel boot are mutually exclusive")
+		}
+
+		if conf.FirmwareVolume == "" {
+			return errors.New("firmware requires a firmware volume (NVRAM template) to be set")
+		}
+	}
+
+	return nil
+}
+
 func (v *libvirt) initLibvirtConnect() error {
 	l := v.funcLogger("initLibvirtConnect")
 	l.Debug()
@@ -140,6 +202,20 @@ func (v *libvirt) initLibvirtDomain() error {
 	return nil
 }
 
+// libvirtError unwraps a libvirt-go error into its virError code and
+// message, logging both so that e.g. "not permitted" can be told apart
+// from "domain missing", and returns an error built from the message.
+func (v *libvirt) libvirtError(l *logrus.Entry, err error) error {
+	virErr, ok := err.(virt.Error)
+	if !ok {
+		return err
+	}
+
+	l.WithField("code", virErr.Code).WithField("domain", virErr.Domain).Error(virErr.Message)
+
+	return errors.New(virErr.Message)
+}
+
 func (v *libvirt) initLibvirt() error {
 	l := v.funcLogger("initLibvirt")
 	l.Debug()
@@ -154,9 +230,111 @@ func (v *libvirt) initLibvirt() error {
 		return err
 	}
 
+	err = v.registerLibvirtEvents()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// registerLibvirtEvents subscribes to the domain lifecycle, reboot and
+// guest agent lifecycle events. Only the STOPPED lifecycle event is
+// passed on to the rest of virtcontainers, through v.stopCh and
+// waitSandboxStop; all other lifecycle events (including crashes),
+// reboot events and agent lifecycle events are only logged.
+func (v *libvirt) registerLibvirtEvents() error {
+	l := v.funcLogger("registerLibvirtEvents")
+	l.Debug()
+
+	if v.stopCh != nil {
+		l.Debug("events already registered")
+		return nil
+	}
+
+	stopCh := make(chan error, 1)
+
+	lifecycleCallback := func(c *virt.Connect, d *virt.Domain, event *virt.DomainEventLifecycle) {
+		l.WithField("event", event.Event).WithField("detail", event.Detail).Debug("lifecycle event")
+
+		if event.Event == virt.DOMAIN_EVENT_STOPPED {
+			select {
+			case stopCh <- nil:
+			default:
+			}
+		}
+	}
+
+	id, err := v.libvirtConnect.DomainEventLifecycleRegister(v.libvirtDomain, lifecycleCallback)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+	v.libvirtLifecycleCallbackID = id
+
+	rebootCallback := func(c *virt.Connect, d *virt.Domain, event *virt.DomainEventReboot) {
+		l.Debug("reboot event")
+	}
+
+	id, err = v.libvirtConnect.DomainEventRebootRegister(v.libvirtDomain, rebootCallback)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+	v.libvirtRebootCallbackID = id
+
+	agentCallback := func(c *virt.Connect, d *virt.Domain, event *virt.DomainEventAgentLifecycle) {
+		l.WithField("state", event.State).WithField("reason", event.Reason).Debug("agent lifecycle event")
+	}
+
+	id, err = v.libvirtConnect.DomainEventAgentLifecycleRegister(v.libvirtDomain, agentCallback)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+	v.libvirtAgentCallbackID = id
+
+	v.stopCh = stopCh
+
+	l.Debug("event callbacks registered")
+
 	return nil
 }
 
+// waitSandboxStop returns a channel that receives a value once the
+// STOPPED lifecycle event has been observed for the domain, so callers
+// don't have to assume Destroy()/Undefine() take effect synchronously.
+// It honors ctx cancellation, and discards any STOPPED event already
+// buffered on v.stopCh (e.g. left over from an earlier saveSandbox,
+// which also triggers one) so a stale event can't be mistaken for the
+// result of whatever stop the caller is about to perform.
+func (v *libvirt) waitSandboxStop(ctx context.Context) <-chan error {
+	l := v.funcLogger("waitSandboxStop")
+	l.Debug()
+
+	out := make(chan error, 1)
+
+	err := v.initLibvirt()
+	if err != nil {
+		out <- err
+		return out
+	}
+
+	select {
+	case <-v.stopCh:
+		l.Debug("discarding stale STOPPED event")
+	default:
+	}
+
+	go func() {
+		select {
+		case err := <-v.stopCh:
+			out <- err
+		case <-ctx.Done():
+			out <- ctx.Err()
+		}
+	}()
+
+	return out
+}
+
 func (v *libvirt) prepareHostFilesystem() error {
 	l := v.funcLogger("prepareHostFilesystem")
 	l.Debug()
@@ -196,9 +374,45 @@ func (v *libvirt) prepareHostFilesystem() error {
 
 	qemuConf.WriteString("stdio_handler = \"file\"\n")
 
+	if v.config.FirmwarePath != "" && v.config.FirmwareVolume != "" {
+		nvramPath := v.nvramPath()
+
+		if _, err := os.Stat(nvramPath); os.IsNotExist(err) {
+			if err := copyFile(v.config.FirmwareVolume, nvramPath); err != nil {
+				return err
+			}
+
+			l.WithField("nvramPath", nvramPath).Debug("NVRAM template copied")
+		}
+	}
+
 	return nil
 }
 
+// nvramPath is where prepareHostFilesystem copies the NVRAM template so
+// each sandbox gets its own writable variable store, rather than
+// sharing (and corrupting) FirmwareVolume across sandboxes.
+func (v *libvirt) nvramPath() string {
+	return filepath.Join(v.libvirtRoot, "nvram")
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
 func uuidRemoveDashes(uuid string) string {
 	chunks := []string{
 		uuid[0:8],
@@ -221,6 +435,22 @@ func uuidAddDashes(uuid string) string {
 	return strings.Join(chunks, "-")
 }
 
+// maxMemory reserves the hotplug memory slots virtio-mem needs at boot
+// time: libvirt refuses to attach memory devices to a domain that
+// wasn't started with a <maxMemory> big enough, and with enough slots,
+// to accommodate them.
+func maxMemory(config *HypervisorConfig) *virtxml.DomainMaxMemory {
+	if config.MemSlots == 0 {
+		return nil
+	}
+
+	return &virtxml.DomainMaxMemory{
+		Unit:  "MiB",
+		Slots: uint(config.MemSlots),
+		Value: uint(config.MemorySize) + uint(config.MemSlots)*1024,
+	}
+}
+
 func (v *libvirt) createSandbox(ctx context.Context, id string, networkNS NetworkNamespace, hypervisorConfig *HypervisorConfig, stateful bool) error {
 	l := v.funcLogger("createSandbox")
 	l.WithField("ctx", ctx).WithField("id", id).WithField("networkNS", networkNS).WithField("hypervisorConfig", hypervisorConfig).WithField("stateful", stateful).Debug()
@@ -233,6 +463,10 @@ func (v *libvirt) createSandbox(ctx context.Context, id string, networkNS Networ
 		return err
 	}
 
+	if err := validateFirmwareConfig(v.config); err != nil {
+		return err
+	}
+
 	// If this symlink exists, it will point to the libvirtRoot we have
 	// created earlier; it not existing is not an error
 	rootLink := filepath.Join(v.store.RunVMStoragePath(), v.id, "libvirt")
@@ -270,6 +504,33 @@ func (v *libvirt) createSandbox(ctx context.Context, id string, networkNS Networ
 
 	kernelCmdline := strings.Join(SerializeParams(kernelParams, "="), " ")
 
+	domainOS := &virtxml.DomainOS{
+		Type: &virtxml.DomainOSType{
+			Type:    "hvm",
+			Machine: v.config.HypervisorMachineType,
+		},
+	}
+
+	if v.config.FirmwarePath != "" {
+		// Confidential-computing and secure-boot guests boot through
+		// OVMF instead of a direct kernel+initrd boot; each sandbox
+		// gets its own NVRAM variable store, copied into libvirtRoot
+		// by prepareHostFilesystem.
+		domainOS.Loader = &virtxml.DomainLoader{
+			Path:     v.config.FirmwarePath,
+			Readonly: "yes",
+			Type:     "pflash",
+		}
+		domainOS.NVRam = &virtxml.DomainNVRam{
+			NVRam:    v.nvramPath(),
+			Template: v.config.FirmwareVolume,
+		}
+	} else {
+		domainOS.Kernel = v.config.KernelPath
+		domainOS.Initrd = v.config.InitrdPath
+		domainOS.Cmdline = kernelCmdline
+	}
+
 	v.libvirtConfig = &virtxml.Domain{
 		Type: "kvm",
 		UUID: v.libvirtUUID,
@@ -282,15 +543,8 @@ func (v *libvirt) createSandbox(ctx context.Context, id string, networkNS Networ
 			Unit:  "MiB",
 			Value: uint(v.config.MemorySize),
 		},
-		OS: &virtxml.DomainOS{
-			Type: &virtxml.DomainOSType{
-				Type:    "hvm",
-				Machine: v.config.HypervisorMachineType,
-			},
-			Kernel:  v.config.KernelPath,
-			Initrd:  v.config.InitrdPath,
-			Cmdline: kernelCmdline,
-		},
+		MaxMemory: maxMemory(v.config),
+		OS:        domainOS,
 		Features: &virtxml.DomainFeatureList{
 			ACPI: &virtxml.DomainFeature{},
 			APIC: &virtxml.DomainFeatureAPIC{},
@@ -411,9 +665,78 @@ func (v *libvirt) startSandbox(timeout int) error {
 
 	l.Debug("domain created")
 
+	consolePath, err := v.getSandboxConsole(v.id)
+	if err != nil {
+		return err
+	}
+
+	v.consoleStopCh = make(chan struct{})
+	go v.consoleProxy(consolePath, v.consoleStopCh)
+
 	return nil
 }
 
+// consoleProxy dials the console.sock bound by the domain (mode=bind
+// means libvirt is the server, so we connect as the client once the
+// domain has been created) and forwards every line it reads to the
+// logger, also retaining it in the bounded ring buffer consumed by
+// getSandboxConsoleOutput. It keeps retrying the dial until it
+// succeeds, since the domain may still be starting up, but gives up
+// as soon as stopCh is closed so the goroutine doesn't outlive the
+// sandbox.
+func (v *libvirt) consoleProxy(consolePath string, stopCh <-chan struct{}) {
+	l := v.funcLogger("consoleProxy")
+	l.WithField("consolePath", consolePath).Debug()
+
+	var conn net.Conn
+	var err error
+
+	for {
+		conn, err = net.Dial("unix", consolePath)
+		if err == nil {
+			break
+		}
+
+		l.WithError(err).Debug("waiting for guest console socket")
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-stopCh:
+			l.Debug("giving up on guest console socket: sandbox stopped")
+			return
+		}
+	}
+	defer conn.Close()
+
+	l.Debug("connected to guest console")
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		v.logger().WithField("source", "guest-console").Debug(line)
+		v.appendConsoleOutput(line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		l.WithError(err).Debug("guest console connection closed")
+	}
+}
+
+// appendConsoleOutput records a line of guest console output in the
+// ring buffer, dropping the oldest bytes once consoleRingBufferSize is
+// exceeded.
+func (v *libvirt) appendConsoleOutput(line string) {
+	v.consoleMu.Lock()
+	defer v.consoleMu.Unlock()
+
+	v.consoleBuf = append(v.consoleBuf, []byte(line+"\n")...)
+
+	if len(v.consoleBuf) > consoleRingBufferSize {
+		v.consoleBuf = v.consoleBuf[len(v.consoleBuf)-consoleRingBufferSize:]
+	}
+}
+
 func (v *libvirt) stopSandbox() error {
 	l := v.funcLogger("stopSandbox")
 	l.Debug()
@@ -423,6 +746,8 @@ func (v *libvirt) stopSandbox() error {
 		return err
 	}
 
+	stopCh := v.waitSandboxStop(context.Background())
+
 	err = v.libvirtDomain.Destroy()
 	if err == nil {
 		l.Debug("domain destroyed")
@@ -430,6 +755,16 @@ func (v *libvirt) stopSandbox() error {
 		l.Debug("failed to destroy domain")
 	}
 
+	select {
+	case err := <-stopCh:
+		if err != nil {
+			return err
+		}
+		l.Debug("domain reported stopped")
+	case <-time.After(stopSandboxTimeout):
+		l.Warn("timed out waiting for STOPPED lifecycle event")
+	}
+
 	err = v.libvirtDomain.Undefine()
 	if err != nil {
 		return err
@@ -437,22 +772,130 @@ func (v *libvirt) stopSandbox() error {
 
 	l.Debug("domain undefined")
 
+	v.stopConsoleProxy()
+
 	return nil
 }
 
+// stopConsoleProxy signals a running consoleProxy goroutine to stop
+// retrying and return, if one was started by startSandbox.
+func (v *libvirt) stopConsoleProxy() {
+	if v.consoleStopCh == nil {
+		return
+	}
+
+	close(v.consoleStopCh)
+	v.consoleStopCh = nil
+}
+
 func (v *libvirt) pauseSandbox() error {
-	v.logger().Info("pauseSandbox() called")
-	return errors.New("pauseSandbox() failed")
+	l := v.funcLogger("pauseSandbox")
+	l.Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return err
+	}
+
+	state, _, err := v.libvirtDomain.GetState()
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	switch state {
+	case virt.DOMAIN_PAUSED:
+		return errors.New("domain is already paused")
+	case virt.DOMAIN_SHUTOFF, virt.DOMAIN_CRASHED:
+		return errors.New("domain is not running")
+	}
+
+	err = v.libvirtDomain.Suspend()
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	l.Debug("domain suspended")
+
+	return nil
 }
 
 func (v *libvirt) resumeSandbox() error {
-	v.logger().Info("resumeSandbox() called")
-	return errors.New("resumeSandbox() failed")
+	l := v.funcLogger("resumeSandbox")
+	l.Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return err
+	}
+
+	state, _, err := v.libvirtDomain.GetState()
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	switch state {
+	case virt.DOMAIN_RUNNING:
+		return errors.New("domain is not paused")
+	case virt.DOMAIN_SHUTOFF, virt.DOMAIN_CRASHED:
+		return errors.New("domain is not running")
+	}
+
+	err = v.libvirtDomain.Resume()
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	l.Debug("domain resumed")
+
+	return nil
+}
+
+func (v *libvirt) stateImagePath() string {
+	return filepath.Join(v.store.RunVMStoragePath(), v.id, libvirtStateImageFile)
 }
 
 func (v *libvirt) saveSandbox() error {
-	v.logger().Info("saveSandbox() called")
-	return errors.New("saveSandbox() failed")
+	l := v.funcLogger("saveSandbox")
+	l.Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return err
+	}
+
+	statePath := v.stateImagePath()
+
+	err = v.libvirtDomain.SaveFlags(statePath, "", virt.DOMAIN_SAVE_RUNNING)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	l.WithField("statePath", statePath).Debug("domain saved")
+
+	return nil
+}
+
+// restoreSandbox brings back a domain previously suspended to disk by
+// saveSandbox, reading the state image from the same deterministic path.
+func (v *libvirt) restoreSandbox() error {
+	l := v.funcLogger("restoreSandbox")
+	l.Debug()
+
+	err := v.initLibvirtConnect()
+	if err != nil {
+		return err
+	}
+
+	statePath := v.stateImagePath()
+
+	err = v.libvirtConnect.DomainRestore(statePath)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	l.WithField("statePath", statePath).Debug("domain restored")
+
+	return nil
 }
 
 func (v *libvirt) addDevice(devInfo interface{}, devType deviceType) error {
@@ -518,62 +961,676 @@ func (v *libvirt) addDevice(devInfo interface{}, devType deviceType) error {
 	return nil
 }
 
-func (v *libvirt) hotplugAddDevice(devInfo interface{}, devType deviceType) (interface{}, error) {
-	v.logger().Info("hotplugAddDevice() called")
-	return nil, errors.New("hotplugAddDevice() failed")
-}
+// marshalDeviceXML renders a single virtxml device fragment (as opposed
+// to a whole domain) the way AttachDeviceFlags/DetachDeviceFlags expect
+// it: just the element, not a wrapping <domain>.
+func marshalDeviceXML(fragment interface{}) (string, error) {
+	out, err := xml.Marshal(fragment)
+	if err != nil {
+		return "", err
+	}
 
-func (v *libvirt) hotplugRemoveDevice(devInfo interface{}, devType deviceType) (interface{}, error) {
-	v.logger().Info("hotplugRemoveDevice() called")
-	return nil, errors.New("hotplugRemoveDevice() failed")
+	return string(out), nil
 }
 
-func (v *libvirt) getSandboxConsole(id string) (string, error) {
-	l := v.funcLogger("getSandboxConsole")
-	l.WithField("id", id).Debug()
-
-	return utils.BuildSocketPath(v.store.RunVMStoragePath(), id, libvirtConsoleSocket)
-}
+// hotplugAddDevice attaches devInfo to the running (and persistent)
+// domain, mirroring the change into v.libvirtConfig.Devices so that a
+// later save()/toGrpc() dumps a consistent picture of the domain.
+func (v *libvirt) hotplugAddDevice(devInfo interface{}, devType deviceType) (interface{}, error) {
+	l := v.funcLogger("hotplugAddDevice")
+	l.WithField("devInfo", devInfo).WithField("devType", devType).Debug()
 
-func (v *libvirt) resizeMemory(reqMemMB uint32, memoryBlockSizeMB uint32, probe bool) (uint32, memoryDevice, error) {
-	l := v.funcLogger("resizeMemory")
-	l.WithField("reqMemMB", reqMemMB).WithField("memoryBlockSizeMB", memoryBlockSizeMB).WithField("probe", probe).Debug()
+	err := v.initLibvirt()
+	if err != nil {
+		return nil, err
+	}
 
-	return 0, memoryDevice{}, errors.New("resizeMemory() failed")
-}
-func (v *libvirt) resizeVCPUs(reqVCPUs uint32) (uint32, uint32, error) {
-	l := v.funcLogger("resizeVCPUs")
-	l.WithField("reqVCPUs", reqVCPUs).Debug()
+	if devType == cpuDev {
+		vcpus, ok := devInfo.(uint32)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for cpuDev", devInfo)
+		}
 
-	maxVCPUs := uint32(v.libvirtConfig.VCPU.Value)
+		err = v.libvirtDomain.SetVcpusFlags(uint(vcpus), virt.DOMAIN_VCPU_LIVE|virt.DOMAIN_VCPU_CONFIG)
+		if err != nil {
+			return nil, v.libvirtError(l, err)
+		}
 
-	if reqVCPUs > maxVCPUs {
-		// Can't go beyond the max
-		l.WithField("reqVCPUs", reqVCPUs).WithField("maxVCPUs", maxVCPUs).Warn("Capped vCPUs")
-		reqVCPUs = maxVCPUs
+		return devInfo, nil
 	}
 
-	err := v.initLibvirt()
-	if err != nil {
-		return 0, 0, err
-	}
+	var devXML string
+	var devKey string
 
-	tmp, err := v.libvirtDomain.GetVcpusFlags(virt.DOMAIN_VCPU_LIVE)
-	if err != nil {
-		return 0, 0, err
+	// Memory devices have no path or BDF of their own to key off of
+	// once hotplugged, so the one we just attached is identified by
+	// diffing the domain's memory device addresses before and after.
+	var memBefore map[string]bool
+	if devType == memoryDev {
+		memBefore, err = v.memoryDeviceAddressKeys("dimm")
+		if err != nil {
+			return nil, err
+		}
 	}
-	// Negative values are only returned for errors
-	oldVCPUs := uint32(tmp)
 
-	if oldVCPUs == reqVCPUs {
-		// Nothing to do
-		return oldVCPUs, oldVCPUs, nil
-	}
+	switch devType {
+	case netDev:
+		ep, ok := devInfo.(Endpoint)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for netDev", devInfo)
+		}
 
-	err = v.libvirtDomain.SetVcpusFlags(uint(reqVCPUs), virt.DOMAIN_VCPU_LIVE)
-	if err != nil {
-		return 0, 0, err
-	}
+		devKey = ep.NetworkPair().TapInterface.TAPIface.Name
+
+		iface := &virtxml.DomainInterface{
+			Source: &virtxml.DomainInterfaceSource{
+				Ethernet: &virtxml.DomainInterfaceSourceEthernet{},
+			},
+			Target: &virtxml.DomainInterfaceTarget{
+				Dev:     devKey,
+				Managed: "no",
+			},
+			Model: &virtxml.DomainInterfaceModel{
+				Type: "virtio",
+			},
+			MAC: &virtxml.DomainInterfaceMAC{
+				Address: ep.HardwareAddr(),
+			},
+		}
+
+		devXML, err = marshalDeviceXML(iface)
+		if err == nil {
+			v.libvirtConfig.Devices.Interfaces = append(v.libvirtConfig.Devices.Interfaces, *iface)
+		}
+	case blockDev:
+		drive, ok := devInfo.(*config.BlockDrive)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for blockDev", devInfo)
+		}
+
+		devKey = drive.File
+
+		disk := &virtxml.DomainDisk{
+			Device: "disk",
+			Driver: &virtxml.DomainDiskDriver{
+				Name: "qemu",
+				Type: drive.Format,
+			},
+			Source: &virtxml.DomainDiskSource{
+				File: &virtxml.DomainDiskSourceFile{
+					File: drive.File,
+				},
+			},
+			Target: &virtxml.DomainDiskTarget{
+				Bus: "virtio",
+			},
+		}
+
+		devXML, err = marshalDeviceXML(disk)
+		if err == nil {
+			v.libvirtConfig.Devices.Disks = append(v.libvirtConfig.Devices.Disks, *disk)
+		}
+	case vfioDev:
+		vfio, ok := devInfo.(*config.VFIODev)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for vfioDev", devInfo)
+		}
+
+		devKey = vfio.BDF
+
+		hostdev := &virtxml.DomainHostdev{
+			SubsysPCI: &virtxml.DomainHostdevSubsysPCI{
+				Source: &virtxml.DomainHostdevSubsysPCISource{
+					Address: pciAddressFromBDF(vfio.BDF),
+				},
+			},
+		}
+
+		devXML, err = marshalDeviceXML(hostdev)
+		if err == nil {
+			v.libvirtConfig.Devices.Hostdevs = append(v.libvirtConfig.Devices.Hostdevs, *hostdev)
+		}
+	case vhostuserDev:
+		vhu, ok := devInfo.(*config.VhostUserDeviceAttrs)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for vhostuserDev", devInfo)
+		}
+
+		devKey = vhu.SocketPath
+
+		iface := &virtxml.DomainInterface{
+			Source: &virtxml.DomainInterfaceSource{
+				VHostUser: &virtxml.DomainChardevSource{
+					UNIX: &virtxml.DomainChardevSourceUNIX{
+						Mode: "client",
+						Path: vhu.SocketPath,
+					},
+				},
+			},
+			Model: &virtxml.DomainInterfaceModel{
+				Type: "virtio",
+			},
+			MAC: &virtxml.DomainInterfaceMAC{
+				Address: vhu.MacAddress,
+			},
+		}
+
+		devXML, err = marshalDeviceXML(iface)
+		if err == nil {
+			v.libvirtConfig.Devices.Interfaces = append(v.libvirtConfig.Devices.Interfaces, *iface)
+		}
+	case memoryDev:
+		mem, ok := devInfo.(*memoryDevice)
+		if !ok {
+			return nil, fmt.Errorf("hotplugAddDevice: unexpected type %T for memoryDev", devInfo)
+		}
+
+		dimm := &virtxml.DomainMemory{
+			Model: "dimm",
+			Target: &virtxml.DomainMemoryTarget{
+				Size: &virtxml.DomainMemoryTargetSize{
+					Unit:  "MiB",
+					Value: uint(mem.sizeMB),
+				},
+			},
+		}
+
+		devXML, err = marshalDeviceXML(dimm)
+		if err == nil {
+			v.libvirtConfig.Devices.Memorys = append(v.libvirtConfig.Devices.Memorys, *dimm)
+		}
+	default:
+		return nil, fmt.Errorf("hotplugAddDevice: unsupported device type %v", devType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.libvirtDomain.AttachDeviceFlags(devXML, virt.DOMAIN_DEVICE_MODIFY_LIVE|virt.DOMAIN_DEVICE_MODIFY_CONFIG)
+	if err != nil {
+		return nil, v.libvirtError(l, err)
+	}
+
+	l.WithField("devXML", devXML).Debug("device attached")
+
+	var addr interface{}
+
+	if devType == memoryDev {
+		memAddr, aerr := v.newMemoryDeviceAddress("dimm", memBefore)
+		if aerr != nil {
+			l.WithError(aerr).Warn("failed to read back hotplugged device address")
+		} else {
+			addr = formatPCIAddress(memAddr)
+			// Record the address libvirt assigned on the dimm entry we
+			// just appended, so hotplugRemoveDevice can later identify
+			// exactly this device instead of guessing by size.
+			v.libvirtConfig.Devices.Memorys[len(v.libvirtConfig.Devices.Memorys)-1].Address = memAddr
+		}
+	} else {
+		var aerr error
+		addr, aerr = v.hotplugDeviceAddress(devKey)
+		if aerr != nil {
+			l.WithError(aerr).Warn("failed to read back hotplugged device address")
+		}
+	}
+
+	return addr, nil
+}
+
+// hotplugRemoveDevice detaches devInfo from the running (and persistent)
+// domain, removing the matching entry from v.libvirtConfig.Devices.
+func (v *libvirt) hotplugRemoveDevice(devInfo interface{}, devType deviceType) (interface{}, error) {
+	l := v.funcLogger("hotplugRemoveDevice")
+	l.WithField("devInfo", devInfo).WithField("devType", devType).Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return nil, err
+	}
+
+	if devType == cpuDev {
+		vcpus, ok := devInfo.(uint32)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for cpuDev", devInfo)
+		}
+
+		err = v.libvirtDomain.SetVcpusFlags(uint(vcpus), virt.DOMAIN_VCPU_LIVE|virt.DOMAIN_VCPU_CONFIG)
+		if err != nil {
+			return nil, v.libvirtError(l, err)
+		}
+
+		return devInfo, nil
+	}
+
+	var devXML string
+
+	switch devType {
+	case netDev:
+		ep, ok := devInfo.(Endpoint)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for netDev", devInfo)
+		}
+
+		devName := ep.NetworkPair().TapInterface.TAPIface.Name
+
+		for i, iface := range v.libvirtConfig.Devices.Interfaces {
+			if iface.Target != nil && iface.Target.Dev == devName {
+				devXML, err = marshalDeviceXML(&iface)
+				v.libvirtConfig.Devices.Interfaces = append(v.libvirtConfig.Devices.Interfaces[:i], v.libvirtConfig.Devices.Interfaces[i+1:]...)
+				break
+			}
+		}
+	case blockDev:
+		drive, ok := devInfo.(*config.BlockDrive)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for blockDev", devInfo)
+		}
+
+		for i, disk := range v.libvirtConfig.Devices.Disks {
+			if disk.Source != nil && disk.Source.File != nil && disk.Source.File.File == drive.File {
+				devXML, err = marshalDeviceXML(&disk)
+				v.libvirtConfig.Devices.Disks = append(v.libvirtConfig.Devices.Disks[:i], v.libvirtConfig.Devices.Disks[i+1:]...)
+				break
+			}
+		}
+	case vfioDev:
+		vfio, ok := devInfo.(*config.VFIODev)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for vfioDev", devInfo)
+		}
+
+		for i, hostdev := range v.libvirtConfig.Devices.Hostdevs {
+			if hostdev.SubsysPCI != nil && hostdev.SubsysPCI.Source != nil &&
+				pciAddressBDF(hostdev.SubsysPCI.Source.Address) == vfio.BDF {
+				devXML, err = marshalDeviceXML(&hostdev)
+				v.libvirtConfig.Devices.Hostdevs = append(v.libvirtConfig.Devices.Hostdevs[:i], v.libvirtConfig.Devices.Hostdevs[i+1:]...)
+				break
+			}
+		}
+	case vhostuserDev:
+		vhu, ok := devInfo.(*config.VhostUserDeviceAttrs)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for vhostuserDev", devInfo)
+		}
+
+		for i, iface := range v.libvirtConfig.Devices.Interfaces {
+			if iface.Source != nil && iface.Source.VHostUser != nil && iface.Source.VHostUser.UNIX != nil &&
+				iface.Source.VHostUser.UNIX.Path == vhu.SocketPath {
+				devXML, err = marshalDeviceXML(&iface)
+				v.libvirtConfig.Devices.Interfaces = append(v.libvirtConfig.Devices.Interfaces[:i], v.libvirtConfig.Devices.Interfaces[i+1:]...)
+				break
+			}
+		}
+	case memoryDev:
+		mem, ok := devInfo.(*memoryDevice)
+		if !ok {
+			return nil, fmt.Errorf("hotplugRemoveDevice: unexpected type %T for memoryDev", devInfo)
+		}
+
+		for i, dimm := range v.libvirtConfig.Devices.Memorys {
+			if dimm.Address == nil || dimm.Address.PCI == nil {
+				continue
+			}
+
+			slot, serr := pciSlotFromAddress(dimm.Address.PCI)
+			if serr != nil || slot != mem.addr {
+				continue
+			}
+
+			devXML, err = marshalDeviceXML(&dimm)
+			v.libvirtConfig.Devices.Memorys = append(v.libvirtConfig.Devices.Memorys[:i], v.libvirtConfig.Devices.Memorys[i+1:]...)
+			break
+		}
+	default:
+		return nil, fmt.Errorf("hotplugRemoveDevice: unsupported device type %v", devType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if devXML == "" {
+		return nil, fmt.Errorf("hotplugRemoveDevice: no matching device found for %v", devInfo)
+	}
+
+	err = v.libvirtDomain.DetachDeviceFlags(devXML, virt.DOMAIN_DEVICE_MODIFY_LIVE|virt.DOMAIN_DEVICE_MODIFY_CONFIG)
+	if err != nil {
+		return nil, v.libvirtError(l, err)
+	}
+
+	l.WithField("devXML", devXML).Debug("device detached")
+
+	return devInfo, nil
+}
+
+// hotplugDeviceAddress re-reads the domain XML after a hotplug operation
+// and returns the PCI/bus address libvirt assigned to the device whose
+// target device, vhost-user socket path, disk source file or host PCI
+// address matches devKey.
+func (v *libvirt) hotplugDeviceAddress(devKey string) (string, error) {
+	desc, err := v.libvirtDomain.GetXMLDesc(virt.DOMAIN_XML_SECURE)
+	if err != nil {
+		return "", v.libvirtError(v.funcLogger("hotplugDeviceAddress"), err)
+	}
+
+	var domain virtxml.Domain
+	if err := domain.Unmarshal(desc); err != nil {
+		return "", err
+	}
+
+	for _, iface := range domain.Devices.Interfaces {
+		if iface.Target != nil && iface.Target.Dev == devKey && iface.Address != nil {
+			return formatPCIAddress(iface.Address), nil
+		}
+		if iface.Source != nil && iface.Source.VHostUser != nil && iface.Source.VHostUser.UNIX != nil &&
+			iface.Source.VHostUser.UNIX.Path == devKey && iface.Address != nil {
+			return formatPCIAddress(iface.Address), nil
+		}
+	}
+
+	for _, disk := range domain.Devices.Disks {
+		if disk.Source != nil && disk.Source.File != nil && disk.Source.File.File == devKey && disk.Address != nil {
+			return formatPCIAddress(disk.Address), nil
+		}
+	}
+
+	for _, hostdev := range domain.Devices.Hostdevs {
+		if hostdev.SubsysPCI != nil && hostdev.SubsysPCI.Source != nil &&
+			pciAddressBDF(hostdev.SubsysPCI.Source.Address) == devKey && hostdev.Address != nil {
+			return formatPCIAddress(hostdev.Address), nil
+		}
+	}
+
+	return "", fmt.Errorf("hotplugDeviceAddress: device %q not found in domain XML", devKey)
+}
+
+// memoryDeviceAddressKeys returns the set of PCI addresses currently
+// assigned to memory devices of the given model ("dimm" or
+// "virtio-mem"). It's used to snapshot state before a hotplug so the
+// newly-attached device can be told apart from devices already present,
+// since unlike interfaces/disks/hostdevs a memory device has no path or
+// BDF of its own to match against.
+func (v *libvirt) memoryDeviceAddressKeys(model string) (map[string]bool, error) {
+	desc, err := v.libvirtDomain.GetXMLDesc(virt.DOMAIN_XML_SECURE)
+	if err != nil {
+		return nil, v.libvirtError(v.funcLogger("memoryDeviceAddressKeys"), err)
+	}
+
+	var domain virtxml.Domain
+	if err := domain.Unmarshal(desc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+
+	for _, mem := range domain.Devices.Memorys {
+		if mem.Model == model && mem.Address != nil {
+			keys[formatPCIAddress(mem.Address)] = true
+		}
+	}
+
+	return keys, nil
+}
+
+// newMemoryDeviceAddress re-reads the domain XML after a hotplug and
+// returns the address of the first memory device of the given model
+// whose address wasn't already present in before, i.e. the one that was
+// just attached.
+func (v *libvirt) newMemoryDeviceAddress(model string, before map[string]bool) (*virtxml.DomainAddress, error) {
+	desc, err := v.libvirtDomain.GetXMLDesc(virt.DOMAIN_XML_SECURE)
+	if err != nil {
+		return nil, v.libvirtError(v.funcLogger("newMemoryDeviceAddress"), err)
+	}
+
+	var domain virtxml.Domain
+	if err := domain.Unmarshal(desc); err != nil {
+		return nil, err
+	}
+
+	for _, mem := range domain.Devices.Memorys {
+		if mem.Model != model || mem.Address == nil {
+			continue
+		}
+		if !before[formatPCIAddress(mem.Address)] {
+			return mem.Address, nil
+		}
+	}
+
+	return nil, fmt.Errorf("newMemoryDeviceAddress: no new %s device address found", model)
+}
+
+// formatPCIAddress renders a virtxml address as a "domain:bus:slot.function"
+// string, the format the guest kernel exposes under /sys/bus/pci/devices.
+func formatPCIAddress(addr *virtxml.DomainAddress) string {
+	if addr == nil || addr.PCI == nil {
+		return ""
+	}
+
+	return pciAddressBDF(addr.PCI)
+}
+
+// pciSlotFromAddress extracts just the PCI slot number out of a virtxml
+// address, as a uint32, for callers (like memoryDevice.addr) that only
+// care about the slot rather than the full domain:bus:slot.function.
+func pciSlotFromAddress(addr *virtxml.DomainAddressPCI) (uint32, error) {
+	if addr == nil || addr.Slot == nil {
+		return 0, errors.New("pciSlotFromAddress: missing PCI slot")
+	}
+
+	slot, err := strconv.ParseUint(*addr.Slot, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(slot), nil
+}
+
+// pciAddressFromBDF turns a "domain:bus:slot.function" host BDF string
+// into the virtxml representation used for hostdev passthrough sources.
+func pciAddressFromBDF(bdf string) *virtxml.DomainAddressPCI {
+	parts := strings.FieldsFunc(bdf, func(r rune) bool {
+		return r == ':' || r == '.'
+	})
+	if len(parts) != 4 {
+		return &virtxml.DomainAddressPCI{}
+	}
+
+	return &virtxml.DomainAddressPCI{
+		Domain:   &parts[0],
+		Bus:      &parts[1],
+		Slot:     &parts[2],
+		Function: &parts[3],
+	}
+}
+
+// pciAddressBDF is the inverse of pciAddressFromBDF, rendering a virtxml
+// PCI address back into "domain:bus:slot.function" form for comparison
+// against the host BDF strings config.VFIODev carries around.
+func pciAddressBDF(addr *virtxml.DomainAddressPCI) string {
+	if addr == nil || addr.Domain == nil || addr.Bus == nil || addr.Slot == nil || addr.Function == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%s:%s.%s", *addr.Domain, *addr.Bus, *addr.Slot, *addr.Function)
+}
+
+func (v *libvirt) getSandboxConsole(id string) (string, error) {
+	l := v.funcLogger("getSandboxConsole")
+	l.WithField("id", id).Debug()
+
+	return utils.BuildSocketPath(v.store.RunVMStoragePath(), id, libvirtConsoleSocket)
+}
+
+// getSandboxConsoleOutput returns the most recent guest console output
+// retained by consoleProxy, so the shim can include it in sandbox-failed
+// errors, similar to how the qemu and firecracker drivers surface boot
+// logs.
+func (v *libvirt) getSandboxConsoleOutput() ([]byte, error) {
+	v.consoleMu.Lock()
+	defer v.consoleMu.Unlock()
+
+	out := make([]byte, len(v.consoleBuf))
+	copy(out, v.consoleBuf)
+
+	return out, nil
+}
+
+// alignMemory rounds memMB up to the nearest multiple of blockSizeMB,
+// since virtio-mem (and the balloon-less config we boot with) can only
+// grow/shrink in block-sized increments.
+func alignMemory(memMB, blockSizeMB uint32) uint32 {
+	if blockSizeMB == 0 {
+		return memMB
+	}
+
+	blocks := (memMB + blockSizeMB - 1) / blockSizeMB
+
+	return blocks * blockSizeMB
+}
+
+// resizeMemory grows or shrinks the domain's memory. Requests that fit
+// within the boot memory are handled with a plain SetMemoryFlags call;
+// requests beyond it are satisfied by hotplugging a virtio-mem device
+// for the delta, since the domain is booted with the balloon disabled.
+func (v *libvirt) resizeMemory(reqMemMB uint32, memoryBlockSizeMB uint32, probe bool) (uint32, memoryDevice, error) {
+	l := v.funcLogger("resizeMemory")
+	l.WithField("reqMemMB", reqMemMB).WithField("memoryBlockSizeMB", memoryBlockSizeMB).WithField("probe", probe).Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return 0, memoryDevice{}, err
+	}
+
+	bootMemMB := uint32(v.libvirtConfig.Memory.Value)
+	currentMemMB := bootMemMB + v.libvirtMemHotplugMB
+
+	if reqMemMB <= bootMemMB {
+		newMemMB := alignMemory(reqMemMB, memoryBlockSizeMB)
+
+		if probe {
+			return newMemMB, memoryDevice{}, nil
+		}
+
+		if newMemMB == currentMemMB {
+			// Nothing to do: the domain already has exactly the
+			// requested amount, so SetMemoryFlags is skipped.
+			return newMemMB, memoryDevice{}, nil
+		}
+
+		err = v.libvirtDomain.SetMemoryFlags(uint64(newMemMB)*1024, virt.DOMAIN_MEM_LIVE|virt.DOMAIN_MEM_CONFIG)
+		if err != nil {
+			return 0, memoryDevice{}, v.libvirtError(l, err)
+		}
+
+		l.WithField("newMemMB", newMemMB).Debug("memory resized")
+
+		return newMemMB, memoryDevice{}, nil
+	}
+
+	totalHotplugMB := alignMemory(reqMemMB-bootMemMB, memoryBlockSizeMB)
+
+	if totalHotplugMB <= v.libvirtMemHotplugMB {
+		// Already satisfied by memory hotplugged for an earlier
+		// request; nothing further to attach.
+		return currentMemMB, memoryDevice{}, nil
+	}
+
+	delta := totalHotplugMB - v.libvirtMemHotplugMB
+
+	if probe {
+		return bootMemMB + totalHotplugMB, memoryDevice{sizeMB: delta}, nil
+	}
+
+	// Snapshot the virtio-mem addresses already present so the device
+	// we're about to attach can be told apart from one left over from
+	// an earlier resizeMemory call of the same size.
+	memBefore, err := v.memoryDeviceAddressKeys("virtio-mem")
+	if err != nil {
+		l.WithError(err).Warn("failed to snapshot existing virtio-mem addresses")
+	}
+
+	mem := &virtxml.DomainMemory{
+		Model: "virtio-mem",
+		Target: &virtxml.DomainMemoryTarget{
+			Size: &virtxml.DomainMemoryTargetSize{
+				Unit:  "MiB",
+				Value: uint(delta),
+			},
+			Block: &virtxml.DomainMemoryTargetBlock{
+				Unit:  "MiB",
+				Value: uint(memoryBlockSizeMB),
+			},
+			Requested: &virtxml.DomainMemoryTargetRequested{
+				Unit:  "MiB",
+				Value: uint(delta),
+			},
+		},
+	}
+
+	devXML, err := marshalDeviceXML(mem)
+	if err != nil {
+		return 0, memoryDevice{}, err
+	}
+
+	err = v.libvirtDomain.AttachDeviceFlags(devXML, virt.DOMAIN_DEVICE_MODIFY_LIVE)
+	if err != nil {
+		return 0, memoryDevice{}, v.libvirtError(l, err)
+	}
+
+	v.libvirtConfig.Devices.Memorys = append(v.libvirtConfig.Devices.Memorys, *mem)
+	v.libvirtMemHotplugMB = totalHotplugMB
+
+	l.WithField("devXML", devXML).Debug("virtio-mem device attached")
+
+	var addr uint32
+
+	if memBefore == nil {
+		l.Warn("skipping virtio-mem device address lookup: no pre-attach snapshot")
+	} else if memAddr, err := v.newMemoryDeviceAddress("virtio-mem", memBefore); err != nil {
+		l.WithError(err).Warn("failed to read back virtio-mem device address")
+	} else if slot, err := pciSlotFromAddress(memAddr.PCI); err != nil {
+		l.WithError(err).Warn("failed to parse virtio-mem device slot")
+	} else {
+		addr = slot
+	}
+
+	return bootMemMB + totalHotplugMB, memoryDevice{sizeMB: delta, addr: addr}, nil
+}
+
+func (v *libvirt) resizeVCPUs(reqVCPUs uint32) (uint32, uint32, error) {
+	l := v.funcLogger("resizeVCPUs")
+	l.WithField("reqVCPUs", reqVCPUs).Debug()
+
+	maxVCPUs := uint32(v.libvirtConfig.VCPU.Value)
+
+	if reqVCPUs > maxVCPUs {
+		// Can't go beyond the max
+		l.WithField("reqVCPUs", reqVCPUs).WithField("maxVCPUs", maxVCPUs).Warn("Capped vCPUs")
+		reqVCPUs = maxVCPUs
+	}
+
+	err := v.initLibvirt()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp, err := v.libvirtDomain.GetVcpusFlags(virt.DOMAIN_VCPU_LIVE)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Negative values are only returned for errors
+	oldVCPUs := uint32(tmp)
+
+	if oldVCPUs == reqVCPUs {
+		// Nothing to do
+		return oldVCPUs, oldVCPUs, nil
+	}
+
+	err = v.libvirtDomain.SetVcpusFlags(uint(reqVCPUs), virt.DOMAIN_VCPU_LIVE)
+	if err != nil {
+		return 0, 0, err
+	}
 
 	/*
 		for {
@@ -593,12 +1650,110 @@ func (v *libvirt) resizeVCPUs(reqVCPUs uint32) (uint32, uint32, error) {
 }
 
 func (v *libvirt) disconnect() {
-	v.logger().Info("disconnect() called")
+	l := v.funcLogger("disconnect")
+	l.Debug()
+
+	v.stopConsoleProxy()
+
+	if v.stopCh == nil {
+		return
+	}
+
+	if err := v.libvirtConnect.DomainEventDeregister(v.libvirtLifecycleCallbackID); err != nil {
+		l.WithError(err).Warn("failed to deregister lifecycle event callback")
+	}
+
+	if err := v.libvirtConnect.DomainEventDeregister(v.libvirtRebootCallbackID); err != nil {
+		l.WithError(err).Warn("failed to deregister reboot event callback")
+	}
+
+	if err := v.libvirtConnect.DomainEventDeregister(v.libvirtAgentCallbackID); err != nil {
+		l.WithError(err).Warn("failed to deregister agent lifecycle event callback")
+	}
+
+	v.stopCh = nil
 }
 
+// qemuPIDPath returns where the embed driver's qemu process drops its
+// PID file, under the per-sandbox libvirtRoot.
+func (v *libvirt) qemuPIDPath() string {
+	return filepath.Join(v.libvirtRoot, "run", "libvirt", "qemu", "run", v.libvirtConfig.Name+".pid")
+}
+
+// qemuPID returns the host PID of the qemu process backing the domain,
+// reading it from the embed driver's PID file the first time it's
+// needed and caching it on the struct afterwards.
+func (v *libvirt) qemuPID() (int, error) {
+	if v.qemuPid != 0 {
+		return v.qemuPid, nil
+	}
+
+	data, err := ioutil.ReadFile(v.qemuPIDPath())
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	v.qemuPid = pid
+
+	return pid, nil
+}
+
+// getThreadIDs maps each vCPU index to its host kernel thread ID by
+// enumerating /proc/<qemu-pid>/task and matching the qemu_thread_name
+// libvirt gives vCPU threads ("CPU N/KVM"), so callers can apply CPU
+// cgroup affinity to the vCPU kernel threads.
 func (v *libvirt) getThreadIDs() (vcpuThreadIDs, error) {
-	v.logger().Info("getThreadIDs() called")
-	return vcpuThreadIDs{}, errors.New("getThreadIDs() failed")
+	l := v.funcLogger("getThreadIDs")
+	l.Debug()
+
+	err := v.initLibvirt()
+	if err != nil {
+		return vcpuThreadIDs{}, err
+	}
+
+	pid, err := v.qemuPID()
+	if err != nil {
+		return vcpuThreadIDs{}, err
+	}
+
+	taskDir := fmt.Sprintf("/proc/%d/task", pid)
+
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return vcpuThreadIDs{}, err
+	}
+
+	threadIDs := vcpuThreadIDs{
+		vcpus: make(map[int]int),
+	}
+
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(taskDir, entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+
+		var vcpuIndex int
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(comm)), "CPU %d/KVM", &vcpuIndex); err != nil {
+			continue
+		}
+
+		threadIDs.vcpus[vcpuIndex] = tid
+	}
+
+	l.WithField("vcpus", threadIDs.vcpus).Debug("vCPU thread IDs collected")
+
+	return threadIDs, nil
 }
 
 func (v *libvirt) cleanup() error {
@@ -607,28 +1762,148 @@ func (v *libvirt) cleanup() error {
 }
 
 func (v *libvirt) getPids() []int {
-	v.logger().Info("getPids() called")
-	return nil
+	l := v.funcLogger("getPids")
+	l.Debug()
+
+	pid, err := v.qemuPID()
+	if err != nil {
+		l.WithError(err).Debug("qemu PID not available")
+		return nil
+	}
+
+	return []int{pid}
+}
+
+// libvirtGrpcState is what fromGrpc/toGrpc exchange: enough to reattach
+// to the domain across a factory cache round-trip, mirroring the fields
+// save()/load() carry through persistapi.HypervisorState.
+type libvirtGrpcState struct {
+	UUID      string `json:"uuid"`
+	Root      string `json:"root"`
+	URI       string `json:"uri"`
+	DomainXML string `json:"domainXML"`
 }
 
 func (v *libvirt) fromGrpc(ctx context.Context, hypervisorConfig *HypervisorConfig, j []byte) error {
-	v.logger().Info("fromGrpc() called")
-	return errors.New("fromGrpc() failed")
+	l := v.funcLogger("fromGrpc")
+	l.Debug()
+
+	v.config = hypervisorConfig
+
+	var state libvirtGrpcState
+	if err := json.Unmarshal(j, &state); err != nil {
+		return err
+	}
+
+	v.libvirtUUID = state.UUID
+	v.libvirtRoot = state.Root
+	v.libvirtURI = state.URI
+
+	if state.DomainXML != "" {
+		v.libvirtConfig = &virtxml.Domain{}
+		if err := v.libvirtConfig.Unmarshal(state.DomainXML); err != nil {
+			return err
+		}
+	}
+
+	return v.reconnect()
 }
 
 func (v *libvirt) toGrpc() ([]byte, error) {
-	v.logger().Info("toGrpc() called")
-	return nil, errors.New("toGrpc() failed")
+	l := v.funcLogger("toGrpc")
+	l.Debug()
+
+	state := libvirtGrpcState{
+		UUID: v.libvirtUUID,
+		Root: v.libvirtRoot,
+		URI:  v.libvirtURI,
+	}
+
+	if v.libvirtConfig != nil {
+		domXML, err := v.libvirtConfig.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		state.DomainXML = domXML
+	}
+
+	return json.Marshal(state)
 }
 
+// save populates a persistapi.HypervisorState with everything needed to
+// reattach to the domain after a kata-runtime restart: the embed
+// driver's UUID, root and URI, plus the current domain XML so that
+// v.libvirtConfig can be rebuilt without the domain having to be
+// running.
 func (v *libvirt) save() (s persistapi.HypervisorState) {
-	v.logger().Info("save() called")
+	l := v.funcLogger("save")
+	l.Debug()
+
+	s.UUID = v.libvirtUUID
+	s.LibvirtRoot = v.libvirtRoot
+	s.LibvirtURI = v.libvirtURI
+
+	if err := v.initLibvirt(); err != nil {
+		l.WithError(err).Warn("failed to look up domain for persistence")
+		return
+	}
+
+	if v.libvirtDomain != nil {
+		domXML, err := v.libvirtDomain.GetXMLDesc(virt.DOMAIN_XML_INACTIVE)
+		if err != nil {
+			l.WithError(err).Warn("failed to fetch domain XML for persistence")
+		} else {
+			s.LibvirtDomainXML = domXML
+		}
+	}
+
 	return
 }
 
+// load restores the fields save() persisted. It only rebuilds
+// v.libvirtConfig from the persisted domain XML; callers must invoke
+// reconnect() afterwards to get a live connection and domain handle
+// back.
 func (v *libvirt) load(s persistapi.HypervisorState) {
-	v.logger().Info("load() called")
-	return
+	l := v.funcLogger("load")
+	l.Debug()
+
+	v.libvirtUUID = s.UUID
+	v.libvirtRoot = s.LibvirtRoot
+	v.libvirtURI = s.LibvirtURI
+
+	if s.LibvirtDomainXML == "" {
+		return
+	}
+
+	v.libvirtConfig = &virtxml.Domain{}
+	if err := v.libvirtConfig.Unmarshal(s.LibvirtDomainXML); err != nil {
+		l.WithError(err).Warn("failed to parse persisted domain XML")
+		v.libvirtConfig = nil
+	}
+}
+
+// reconnect re-establishes the libvirt connection and domain handle
+// after load(), so that operations issued after a kata-runtime restart
+// (resizeVCPUs, stopSandbox, ...) keep working instead of failing on a
+// nil libvirtConnect/libvirtDomain.
+func (v *libvirt) reconnect() error {
+	l := v.funcLogger("reconnect")
+	l.Debug()
+
+	err := v.initLibvirtConnect()
+	if err != nil {
+		return err
+	}
+
+	v.libvirtDomain, err = v.libvirtConnect.LookupDomainByUUIDString(v.libvirtUUID)
+	if err != nil {
+		return v.libvirtError(l, err)
+	}
+
+	l.Debug("domain reattached")
+
+	return nil
 }
 
 func (v *libvirt) check() error {